@@ -2,39 +2,68 @@
 package confirm
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
 
 	"github.com/volatiletech/authboss"
 	"github.com/volatiletech/authboss/internal/response"
-	"strings"
 	"time"
 )
 
 // Storer and FormValue constants
 const (
-	StoreConfirmToken = "confirm_token"
-	StoreConfirmed    = "confirmed"
+	StoreConfirmToken       = "confirm_token"
+	StoreConfirmTokenExpiry = "confirm_token_expiry"
+	StoreConfirmed          = "confirmed"
+	StoreUnconfirmedEmail   = "unconfirmed_email"
+	StoreConfirmLastSent    = "confirm_last_sent"
 
 	FormValueConfirm = "cnf"
 
 	tplConfirmHTML = "confirm_email.html.tpl"
 	tplConfirmText = "confirm_email.txt.tpl"
 
-	// for randomize confirm token (length 6)
-	TokenLength   = 6
-	letterBytes   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	letterIdxBits = 6                    // 6 bits to represent a letter index
-	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
+	// tplConfirmResend is the web page (not e-mail) shown on a GET to
+	// /confirm/resend -- the page an expired confirm link redirects to -- so
+	// a user can ask for a new confirmation e-mail.
+	tplConfirmResend = "confirm_resend.html.tpl"
+
+	// defaultTokenLength is how many random bytes are read to build a
+	// confirm token when Confirm.TokenLength is left unset.
+	defaultTokenLength = 32
+
+	// minTokenEntropy is the floor below which a confirm token is considered
+	// guessable. GenerateToken rejects any n below it; Initialize does not
+	// check Confirm.TokenLength, and a custom TokenGenerator is not held to it.
+	minTokenEntropy = 16
+
+	// defaultConfirmTokenDuration is how long a confirmation token stays
+	// valid when Confirm.ConfirmTokenDuration is left unset, mirroring the
+	// one-week window most e-mail confirmation flows use.
+	defaultConfirmTokenDuration = 168 * time.Hour
+
+	// defaultConfirmResendCooldown is how long a user must wait between
+	// requests for a new confirmation e-mail when Confirm.ConfirmResendCooldown
+	// is left unset.
+	defaultConfirmResendCooldown = 60 * time.Second
 )
 
 var (
 	errUserMissing = errors.New("confirm: After registration user must be loaded")
+
+	// ErrConfirmTokenExpired is returned (and redirected on) when a user
+	// follows a confirmation link after its token has expired.
+	ErrConfirmTokenExpired = errors.New("confirm: token expired")
+
+	// ErrTokenEntropyTooLow is returned by GenerateToken (and any
+	// TokenGenerator that chooses to enforce the same floor) when asked for
+	// fewer than minTokenEntropy bytes of randomness.
+	ErrTokenEntropyTooLow = fmt.Errorf("confirm: token must have at least %d bytes of entropy", minTokenEntropy)
 )
 
 // ConfirmStorer must be implemented in order to satisfy the confirm module's
@@ -49,26 +78,55 @@ type ConfirmStorer interface {
 
 func init() {
 	authboss.RegisterModule("confirm", &Confirm{})
-	rand.Seed(time.Now().UnixNano())
 }
 
-// generate random string
-func RandStringBytesMaskImpr(n int) string {
+// GenerateToken is the default Confirm.TokenGenerator. It reads n bytes from
+// crypto/rand and returns them as a URL-safe, unpadded base64 string, which
+// is what gets mailed to the user and stored (hashed or otherwise looked up)
+// by the ConfirmStorer. n is rejected with ErrTokenEntropyTooLow if it falls
+// below minTokenEntropy.
+func GenerateToken(n int) (string, error) {
+	if n < minTokenEntropy {
+		return "", ErrTokenEntropyTooLow
+	}
+
 	b := make([]byte, n)
-	// A rand.Int63() generates 63 random bits, enough for letterIdxMax letters!
-	for i, cache, remain := n-1, rand.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = rand.Int63(), letterIdxMax
-		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			b[i] = letterBytes[idx]
-			i--
-		}
-		cache >>= letterIdxBits
-		remain--
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("confirm: failed to read random bytes: %v", err)
 	}
 
-	return string(b)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tokenExpired reports whether expiresAt has passed. A zero expiresAt means
+// no expiry was ever recorded and is treated as not expired, so confirm
+// tokens issued before StoreConfirmTokenExpiry existed keep working.
+func tokenExpired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && time.Now().UTC().After(expiresAt)
+}
+
+// ConfirmMailContext carries everything a confirmation e-mail might need,
+// both to the default template set and to a custom Confirm.MailBuilder.
+type ConfirmMailContext struct {
+	User      authboss.Attributes
+	Token     string
+	URL       string
+	ExpiresAt time.Time
+	AppName   string
+
+	// To is the address the mail is actually being sent to. During a
+	// register confirmation this matches User[authboss.StoreEmail]; during
+	// an e-mail-change confirmation it's the pending new address, which
+	// hasn't been written to StoreEmail yet.
+	To string
+}
+
+// String makes ConfirmMailContext satisfy fmt.Stringer, so bundled templates
+// that render the bare confirm link as {{.}} keep working unchanged: both
+// text/template and html/template print values through fmt, which favors
+// Stringer over the struct's field dump.
+func (d ConfirmMailContext) String() string {
+	return d.URL
 }
 
 // Confirm module
@@ -76,6 +134,41 @@ type Confirm struct {
 	*authboss.Authboss
 	emailHTMLTemplates response.Templates
 	emailTextTemplates response.Templates
+	resendTemplates    response.Templates
+
+	// ConfirmTokenDuration is how long a confirm token remains valid after
+	// it's issued. Defaults to one week if left unset.
+	ConfirmTokenDuration time.Duration
+
+	// TokenGenerator produces the confirm token written to StoreConfirmToken
+	// and mailed to the user. It defaults to GenerateToken, but can be
+	// swapped out for e.g. a shorter human-readable code for SMS-based
+	// flows. n is TokenLength.
+	TokenGenerator func(n int) (string, error)
+
+	// TokenLength is the n passed to TokenGenerator: the number of random
+	// bytes of entropy (for the default generator) or whatever unit a
+	// custom TokenGenerator expects. Defaults to 32 if left unset.
+	TokenLength int
+
+	// ConfirmResendCooldown is the minimum time a user must wait between
+	// calls to /confirm/resend before another confirmation e-mail is
+	// actually sent. Defaults to 60 seconds if left unset.
+	ConfirmResendCooldown time.Duration
+
+	// AppName is threaded into ConfirmMailContext for use in mail subjects
+	// and templates. Left blank if unset.
+	AppName string
+
+	// MailBuilder, when set, overrides how the confirmation e-mail is
+	// assembled from a ConfirmMailContext, allowing callers to customize
+	// subject, From, Reply-To, headers, or even the body. If the returned
+	// Email already has an HTMLBody or TextBody set (e.g. a multipart
+	// alternative assembled by hand), it's sent as-is; otherwise the
+	// module's own templates render the body as before. Defaults to
+	// defaultMailBuilder, which reproduces the historical behavior (single
+	// templated URL, generic subject, body rendered from templates).
+	MailBuilder func(ctx *authboss.Context, data ConfirmMailContext) (authboss.Email, error)
 }
 
 // Initialize the module
@@ -88,6 +181,19 @@ func (c *Confirm) Initialize(ab *authboss.Authboss) (err error) {
 		return errors.New("confirm: Need a ConfirmStorer")
 	}
 
+	if c.ConfirmTokenDuration == 0 {
+		c.ConfirmTokenDuration = defaultConfirmTokenDuration
+	}
+	if c.TokenGenerator == nil {
+		c.TokenGenerator = GenerateToken
+	}
+	if c.TokenLength == 0 {
+		c.TokenLength = defaultTokenLength
+	}
+	if c.ConfirmResendCooldown == 0 {
+		c.ConfirmResendCooldown = defaultConfirmResendCooldown
+	}
+
 	c.emailHTMLTemplates, err = response.LoadTemplates(ab, c.LayoutHTMLEmail, c.ViewsPath, tplConfirmHTML)
 	if err != nil {
 		return err
@@ -96,6 +202,12 @@ func (c *Confirm) Initialize(ab *authboss.Authboss) (err error) {
 	if err != nil {
 		return err
 	}
+	// tplConfirmResend is new and most integrators won't have authored it
+	// yet, so unlike the e-mail templates above its absence isn't fatal --
+	// confirmResendHandler falls back to a plain redirect when it's unset.
+	if tpls, lErr := response.LoadTemplates(ab, c.Layout, c.ViewsPath, tplConfirmResend); lErr == nil {
+		c.resendTemplates = tpls
+	}
 
 	c.Callbacks.After(authboss.EventGetUser, func(ctx *authboss.Context) error {
 		_, err := c.beforeGet(ctx)
@@ -110,17 +222,21 @@ func (c *Confirm) Initialize(ab *authboss.Authboss) (err error) {
 // Routes for the module
 func (c *Confirm) Routes() authboss.RouteTable {
 	return authboss.RouteTable{
-		"/confirm": c.confirmHandler,
+		"/confirm":        c.confirmHandler,
+		"/confirm/resend": c.confirmResendHandler,
 	}
 }
 
 // Storage requirements
 func (c *Confirm) Storage() authboss.StorageOptions {
 	return authboss.StorageOptions{
-		c.PrimaryID:         authboss.String,
-		authboss.StoreEmail: authboss.String,
-		StoreConfirmToken:   authboss.String,
-		StoreConfirmed:      authboss.Bool,
+		c.PrimaryID:             authboss.String,
+		authboss.StoreEmail:     authboss.String,
+		StoreConfirmToken:       authboss.String,
+		StoreConfirmTokenExpiry: authboss.DateTime,
+		StoreConfirmed:          authboss.Bool,
+		StoreUnconfirmedEmail:   authboss.String,
+		StoreConfirmLastSent:    authboss.DateTime,
 	}
 }
 
@@ -140,10 +256,14 @@ func (c *Confirm) afterRegister(ctx *authboss.Context) error {
 		return errUserMissing
 	}
 
-	// changes to generate 6-characters token
-	token := RandStringBytesMaskImpr(TokenLength)
+	token, err := c.TokenGenerator(c.TokenLength)
+	if err != nil {
+		return err
+	}
 
-	ctx.User[StoreConfirmToken] = strings.ToUpper(token)
+	expiresAt := time.Now().UTC().Add(c.ConfirmTokenDuration)
+	ctx.User[StoreConfirmToken] = token
+	ctx.User[StoreConfirmTokenExpiry] = expiresAt
 
 	if err := ctx.SaveUser(); err != nil {
 		return err
@@ -154,43 +274,110 @@ func (c *Confirm) afterRegister(ctx *authboss.Context) error {
 		return err
 	}
 
-	goConfirmEmail(c, ctx, email, token)
+	goConfirmEmail(c, ctx, email, token, expiresAt)
 
 	return nil
 }
 
-var goConfirmEmail = func(c *Confirm, ctx *authboss.Context, to, token string) {
+// RequestEmailChange begins the process of changing a confirmed user's
+// e-mail address. It generates a fresh confirm token, stashes newEmail in
+// StoreUnconfirmedEmail and mails the confirmation link to newEmail rather
+// than the user's current address. StoreEmail is left untouched until the
+// user actually follows the link.
+func (c *Confirm) RequestEmailChange(ctx *authboss.Context, newEmail string) error {
+	if ctx.User == nil {
+		return errUserMissing
+	}
+
+	token, err := c.TokenGenerator(c.TokenLength)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().UTC().Add(c.ConfirmTokenDuration)
+	ctx.User[StoreConfirmToken] = token
+	ctx.User[StoreConfirmTokenExpiry] = expiresAt
+	ctx.User[StoreUnconfirmedEmail] = newEmail
+
+	if err := ctx.SaveUser(); err != nil {
+		return err
+	}
+
+	goConfirmEmail(c, ctx, newEmail, token, expiresAt)
+
+	return nil
+}
+
+var goConfirmEmail = func(c *Confirm, ctx *authboss.Context, to, token string, expiresAt time.Time) {
 	if ctx.MailMaker != nil {
-		c.confirmEmail(ctx, to, token)
+		c.confirmEmail(ctx, to, token, expiresAt)
 	} else {
-		go c.confirmEmail(ctx, to, token)
+		go c.confirmEmail(ctx, to, token, expiresAt)
 	}
 }
 
-// confirmEmail sends a confirmation e-mail.
-func (c *Confirm) confirmEmail(ctx *authboss.Context, to, token string) {
+// confirmEmail sends a confirmation e-mail. It builds a ConfirmMailContext
+// and hands it to MailBuilder (or defaultMailBuilder, if unset) to produce
+// the authboss.Email actually sent.
+func (c *Confirm) confirmEmail(ctx *authboss.Context, to, token string, expiresAt time.Time) {
 	p := path.Join(c.MountPath, "confirm")
-	url := fmt.Sprintf("%s%s?%s=%s", c.RootURL, p, url.QueryEscape(FormValueConfirm), url.QueryEscape(token))
+	confirmURL := fmt.Sprintf("%s%s?%s=%s", c.RootURL, p, url.QueryEscape(FormValueConfirm), url.QueryEscape(token))
+
+	data := ConfirmMailContext{
+		User:      ctx.User,
+		Token:     token,
+		URL:       confirmURL,
+		ExpiresAt: expiresAt,
+		AppName:   c.AppName,
+		To:        to,
+	}
 
-	email := authboss.Email{
-		To:      []string{to},
-		From:    c.EmailFrom,
-		Subject: c.EmailSubjectPrefix + "Confirm New Account",
+	builder := c.MailBuilder
+	if builder == nil {
+		builder = c.defaultMailBuilder
+	}
+
+	email, err := builder(ctx, data)
+	if err != nil {
+		fmt.Fprintf(ctx.LogWriter, "confirm: Failed to build e-mail: %v", err)
+		return
+	}
+
+	if len(email.HTMLBody) > 0 || len(email.TextBody) > 0 {
+		// MailBuilder already rendered its own body (e.g. a multipart
+		// alternative put together for a transactional provider) -- send it
+		// as-is instead of overwriting it with the module's own templates.
+		if err := ctx.Mailer.Send(email); err != nil {
+			fmt.Fprintf(ctx.LogWriter, "confirm: Failed to send e-mail: %v", err)
+		}
+		return
 	}
 
-	err := response.Email(ctx.Mailer, email, c.emailHTMLTemplates, tplConfirmHTML, c.emailTextTemplates, tplConfirmText, url)
+	err = response.Email(ctx.Mailer, email, c.emailHTMLTemplates, tplConfirmHTML, c.emailTextTemplates, tplConfirmText, data)
 	if err != nil {
 		fmt.Fprintf(ctx.LogWriter, "confirm: Failed to send e-mail: %v", err)
 	}
 }
 
+// defaultMailBuilder reproduces the module's historical e-mail headers: a
+// generic subject sent from EmailFrom to data.To. It sets no body, so the
+// module's templates render it; they receive the whole ConfirmMailContext,
+// whose String() is the confirm URL.
+func (c *Confirm) defaultMailBuilder(ctx *authboss.Context, data ConfirmMailContext) (authboss.Email, error) {
+	return authboss.Email{
+		To:      []string{data.To},
+		From:    c.EmailFrom,
+		Subject: c.EmailSubjectPrefix + "Confirm New Account",
+	}, nil
+}
+
 func (c *Confirm) confirmHandler(ctx *authboss.Context, w http.ResponseWriter, r *http.Request) error {
 	token := r.FormValue(FormValueConfirm)
 	if len(token) == 0 {
 		return authboss.ClientDataErr{Name: FormValueConfirm}
 	}
 
-	user, err := ctx.Storer.(ConfirmStorer).ConfirmUser(strings.ToUpper(token))
+	user, err := ctx.Storer.(ConfirmStorer).ConfirmUser(token)
 	if err == authboss.ErrUserNotFound {
 		return authboss.ErrAndRedirect{Location: "/", Err: errors.New("confirm: token not found")}
 	} else if err != nil {
@@ -199,7 +386,42 @@ func (c *Confirm) confirmHandler(ctx *authboss.Context, w http.ResponseWriter, r
 
 	ctx.User = authboss.Unbind(user)
 
+	// A missing/zero expiry means the token predates StoreConfirmTokenExpiry
+	// (e.g. an account that registered before this field existed) -- treat
+	// that as "no expiry recorded" rather than failing the whole request.
+	var expiry time.Time
+	if v, err := ctx.User.DateTimeErr(StoreConfirmTokenExpiry); err == nil {
+		expiry = v
+	}
+	if tokenExpired(expiry) {
+		return authboss.ErrAndRedirect{
+			Location: path.Join(c.MountPath, "confirm", "resend"),
+			Err:      ErrConfirmTokenExpired,
+		}
+	}
+
 	ctx.User[StoreConfirmToken] = ""
+	ctx.User[StoreConfirmTokenExpiry] = nil
+
+	if newEmail, ok := ctx.User.String(StoreUnconfirmedEmail); ok && len(newEmail) > 0 {
+		// This token confirms a change of e-mail address rather than the
+		// initial registration; swap the address in and let anyone
+		// interested (remember, lock, ...) know it happened.
+		ctx.User[authboss.StoreEmail] = newEmail
+		ctx.User[StoreUnconfirmedEmail] = ""
+
+		if err := ctx.SaveUser(); err != nil {
+			return err
+		}
+
+		if err := c.Callbacks.FireAfter(authboss.EventEmailChanged, ctx); err != nil {
+			return err
+		}
+
+		response.Redirect(ctx, w, r, c.RegisterOKPath, "You have successfully confirmed your new e-mail address.", "", true)
+		return nil
+	}
+
 	ctx.User[StoreConfirmed] = true
 
 	if err := ctx.SaveUser(); err != nil {
@@ -216,3 +438,87 @@ func (c *Confirm) confirmHandler(ctx *authboss.Context, w http.ResponseWriter, r
 
 	return nil
 }
+
+// confirmResendHandler serves the resend request form on GET and, on POST,
+// mails out a fresh confirm token for a user who lost the original one. To
+// avoid leaking which addresses are registered, the POST always redirects
+// with the same message, whether or not a matching user was found, already
+// confirmed, or throttled by ConfirmResendCooldown.
+func (c *Confirm) confirmResendHandler(ctx *authboss.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		// GET is what an expired confirm link redirects to -- show the
+		// "request a new confirmation link" form instead of erroring, and
+		// let the user actually trigger the resend via its POST. Integrators
+		// who haven't authored tplConfirmResend yet get a plain redirect
+		// instead of a broken page.
+		if len(c.resendTemplates) == 0 {
+			response.Redirect(ctx, w, r, c.RegisterOKPath,
+				"Your confirmation link has expired. Submit your e-mail to /confirm/resend to get a new one.", "", true)
+			return nil
+		}
+		return response.Render(ctx, w, r, c.resendTemplates, tplConfirmResend, nil)
+	}
+
+	key := r.FormValue(c.PrimaryID)
+	if len(key) == 0 {
+		key, _ = ctx.SessionStorer.Get(authboss.SessionKey)
+	}
+
+	if len(key) > 0 {
+		if err := c.resendConfirmToken(ctx, key); err != nil && err != authboss.ErrUserNotFound {
+			return err
+		}
+	}
+
+	response.Redirect(ctx, w, r, c.RegisterOKPath,
+		"If an account matching that address exists, we've sent a new confirmation link.", "", true)
+
+	return nil
+}
+
+// resendConfirmToken regenerates and re-mails a confirm token for the user
+// identified by key. It's a silent no-op, never an error, whenever the user
+// can't be resent a token for any reason -- not found, already confirmed,
+// still within ConfirmResendCooldown, or missing an expected attribute --
+// so confirmResendHandler's response never varies by outcome and can't be
+// used to enumerate accounts.
+func (c *Confirm) resendConfirmToken(ctx *authboss.Context, key string) error {
+	user, err := c.Storer.Get(key)
+	if err != nil {
+		return nil
+	}
+	ctx.User = authboss.Unbind(user)
+
+	if confirmed, err := ctx.User.BoolErr(StoreConfirmed); err != nil || confirmed {
+		return nil
+	}
+
+	if lastSent, err := ctx.User.DateTimeErr(StoreConfirmLastSent); err == nil {
+		if time.Now().UTC().Sub(lastSent) < c.ConfirmResendCooldown {
+			return nil
+		}
+	}
+
+	token, err := c.TokenGenerator(c.TokenLength)
+	if err != nil {
+		return nil
+	}
+
+	expiresAt := time.Now().UTC().Add(c.ConfirmTokenDuration)
+	ctx.User[StoreConfirmToken] = token
+	ctx.User[StoreConfirmTokenExpiry] = expiresAt
+	ctx.User[StoreConfirmLastSent] = time.Now().UTC()
+
+	if err := ctx.SaveUser(); err != nil {
+		return nil
+	}
+
+	email, err := ctx.User.StringErr(authboss.StoreEmail)
+	if err != nil {
+		return nil
+	}
+
+	goConfirmEmail(c, ctx, email, token, expiresAt)
+
+	return c.Callbacks.FireAfter(authboss.EventConfirmResend, ctx)
+}
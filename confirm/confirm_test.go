@@ -0,0 +1,69 @@
+package confirm
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateTokenEntropyFloor(t *testing.T) {
+	if _, err := GenerateToken(minTokenEntropy - 1); err != ErrTokenEntropyTooLow {
+		t.Errorf("expected ErrTokenEntropyTooLow for n=%d, got %v", minTokenEntropy-1, err)
+	}
+
+	token, err := GenerateToken(minTokenEntropy)
+	if err != nil {
+		t.Fatalf("expected n=%d to be accepted, got %v", minTokenEntropy, err)
+	}
+	if len(token) == 0 {
+		t.Error("expected a non-empty token")
+	}
+}
+
+func TestGenerateTokenUnique(t *testing.T) {
+	a, err := GenerateToken(defaultTokenLength)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := GenerateToken(defaultTokenLength)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a == b {
+		t.Error("expected two successive tokens to differ")
+	}
+	// base64.RawURLEncoding must not contain characters that need escaping
+	// in a query string.
+	if strings.ContainsAny(a, "+/=") {
+		t.Errorf("token %q contains non-URL-safe characters", a)
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	cases := []struct {
+		name      string
+		expiresAt time.Time
+		expired   bool
+	}{
+		{"zero value means no expiry recorded", time.Time{}, false},
+		{"well in the past", time.Now().UTC().Add(-time.Hour), true},
+		{"well in the future", time.Now().UTC().Add(time.Hour), false},
+		{"boundary: expiry already reached by the time of the check", time.Now().UTC(), true},
+		{"small clock skew into the future", time.Now().UTC().Add(2 * time.Second), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := tokenExpired(c.expiresAt); got != c.expired {
+				t.Errorf("tokenExpired(%v) = %v, want %v", c.expiresAt, got, c.expired)
+			}
+		})
+	}
+}
+
+func TestConfirmMailContextString(t *testing.T) {
+	data := ConfirmMailContext{URL: "https://example.com/confirm?cnf=abc"}
+	if got := data.String(); got != data.URL {
+		t.Errorf("String() = %q, want %q", got, data.URL)
+	}
+}